@@ -0,0 +1,27 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+)
+
+// rootCmd is the wiki binary's entry point; every subcommand is
+// registered on it here in init().
+var rootCmd = &cobra.Command{
+	Use:   "wiki",
+	Short: "wiki is a lightweight wiki server",
+}
+
+func init() {
+	rootCmd.AddCommand(serveCmd)
+	rootCmd.AddCommand(cspGeneratorCmd)
+}
+
+func main() {
+	if err := rootCmd.Execute(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
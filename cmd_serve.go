@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// serveCmd runs the wiki server itself: it binds flags through viper,
+// builds a Config from them and hands it to NewServer.
+var serveCmd = &cobra.Command{
+	Use:   "serve",
+	Short: "Run the wiki server",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		config, err := configFromViper()
+		if err != nil {
+			return err
+		}
+
+		NewServer(config).ListenAndServe()
+
+		return nil
+	},
+}
+
+func init() {
+	flags := serveCmd.Flags()
+
+	flags.String("data", "./data", "path to the directory containing wiki pages")
+	flags.String("brand", "wiki", "name shown in the page title and header")
+	flags.String("bind", ":8000", "address to listen on, unless a systemd socket is inherited")
+	flags.String("indexdir", "", "path to the search index directory")
+	flags.String("store", "fs", "page store driver: fs, git or gitremote")
+	flags.String("git-url", "", "git remote to pull from (and push to, with --git-push)")
+	flags.Bool("git-push", false, "push every save to the git remote")
+	flags.String("host", "", "public hostname, used to build stable Atom feed entry ids")
+	flags.String("domain-start-date", "", "date host was first registered, as YYYY-MM-DD (used alongside --host)")
+	flags.String("base-url", "", "public URL the wiki is served from, e.g. https://wiki.example.com")
+	flags.Bool("dev", false, "enable the live-reload watcher")
+
+	for _, name := range []string{
+		"data", "brand", "bind", "indexdir", "store",
+		"git-url", "git-push", "host", "domain-start-date", "base-url", "dev",
+	} {
+		if err := viper.BindPFlag(name, flags.Lookup(name)); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// configFromViper builds a Config from viper's bound flags, plus a
+// "csp" table when one has been loaded into viper. No config file is
+// read here or elsewhere in this command.
+func configFromViper() (Config, error) {
+	config := Config{
+		data:     viper.GetString("data"),
+		brand:    viper.GetString("brand"),
+		bind:     viper.GetString("bind"),
+		indexdir: viper.GetString("indexdir"),
+		store:    viper.GetString("store"),
+		host:     viper.GetString("host"),
+		baseURL:  viper.GetString("base-url"),
+		dev:      viper.GetBool("dev"),
+		git: Git{
+			url:  viper.GetString("git-url"),
+			push: viper.GetBool("git-push"),
+		},
+		csp: viperCSP(),
+	}
+
+	if s := viper.GetString("domain-start-date"); s != "" {
+		t, err := time.Parse("2006-01-02", s)
+		if err != nil {
+			return Config{}, fmt.Errorf("invalid --domain-start-date %q: %w", s, err)
+		}
+		config.domainStartDate = t
+	}
+
+	return config, nil
+}
+
+// viperCSP converts the "csp" table held in viper, if any (a
+// map[string]interface{} of directive -> []interface{} of strings,
+// as produced by viper.GetStringMap) into Config.csp's
+// map[string][]string.
+func viperCSP() map[string][]string {
+	raw := viper.GetStringMap("csp")
+	if len(raw) == 0 {
+		return nil
+	}
+
+	csp := make(map[string][]string, len(raw))
+
+	for directive, values := range raw {
+		list, ok := values.([]interface{})
+		if !ok {
+			continue
+		}
+
+		strs := make([]string, 0, len(list))
+		for _, v := range list {
+			if s, ok := v.(string); ok {
+				strs = append(strs, s)
+			}
+		}
+
+		csp[directive] = strs
+	}
+
+	return csp
+}
@@ -1,5 +1,7 @@
 package main
 
+import "time"
+
 const FileExtension = ".md"
 
 type Git struct {
@@ -27,4 +29,30 @@ type Config struct {
 	git      Git
 	csrf     Csrf
 	indexdir string
+
+	// host is the public hostname used to build stable feed entry IDs.
+	host string
+	// domainStartDate is when host was first registered, used as the
+	// date component of tag: URIs so entry IDs stay stable even if
+	// page content changes.
+	domainStartDate time.Time
+
+	// store selects the PageStore driver: "fs" (default), "git"
+	// (a checked-out working tree) or "gitremote" (a bare repository
+	// with no working tree at all). The latter two use git.url/
+	// git.push to pull/push against a remote.
+	store string
+
+	// baseURL is the public URL the wiki is served from, e.g.
+	// "https://wiki.example.com", used to build absolute sitemap
+	// and robots.txt links.
+	baseURL string
+
+	// dev enables the --dev live-reload watcher.
+	dev bool
+
+	// csp maps CSP directive names (e.g. "default-src") to their
+	// source list, serialized into the Content-Security-Policy header
+	// by CSPMiddleware.
+	csp map[string][]string
 }
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// cspKeywords are CSP source values that must be single-quoted rather
+// than treated as a URL or scheme.
+var cspKeywords = map[string]bool{
+	"self":           true,
+	"none":           true,
+	"unsafe-inline":  true,
+	"unsafe-eval":    true,
+	"unsafe-hashes":  true,
+	"strict-dynamic": true,
+}
+
+func quoteCSPValue(value string) string {
+	if cspKeywords[value] ||
+		strings.HasPrefix(value, "nonce-") ||
+		strings.HasPrefix(value, "sha256-") ||
+		strings.HasPrefix(value, "sha384-") ||
+		strings.HasPrefix(value, "sha512-") {
+		return "'" + value + "'"
+	}
+	return value
+}
+
+// BuildCSP serializes a Config.csp table into a single
+// Content-Security-Policy header value, in deterministic directive
+// order.
+func BuildCSP(csp map[string][]string) string {
+	directives := make([]string, 0, len(csp))
+	for directive := range csp {
+		directives = append(directives, directive)
+	}
+	sort.Strings(directives)
+
+	parts := make([]string, 0, len(directives))
+	for _, directive := range directives {
+		values := make([]string, len(csp[directive]))
+		for i, value := range csp[directive] {
+			values[i] = quoteCSPValue(value)
+		}
+		parts = append(parts, directive+" "+strings.Join(values, " "))
+	}
+
+	return strings.Join(parts, "; ")
+}
+
+// CSPMiddleware sets a Content-Security-Policy header built from csp
+// on every response.
+func CSPMiddleware(csp map[string][]string, next http.Handler) http.Handler {
+	header := BuildCSP(csp)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if header != "" {
+			w.Header().Set("Content-Security-Policy", header)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCSPMiddlewareRoundTrip(t *testing.T) {
+	csp := map[string][]string{
+		"default-src": {"self"},
+		"script-src":  {"self", "nonce-abc123"},
+	}
+
+	handler := CSPMiddleware(csp, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	req := httptest.NewRequest("GET", "/", nil)
+	rec := httptest.NewRecorder()
+
+	handler.ServeHTTP(rec, req)
+
+	assert.Equal(t, "default-src 'self'; script-src 'self' 'nonce-abc123'", rec.Header().Get("Content-Security-Policy"))
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/julienschmidt/httprouter"
+	"github.com/microcosm-cc/bluemonday"
+	"github.com/russross/blackfriday/v2"
+)
+
+// sseHub fans reload notifications out to clients currently viewing
+// a given page over Server-Sent Events.
+type sseHub struct {
+	mu      sync.Mutex
+	clients map[string]map[chan string]struct{}
+}
+
+func newSSEHub() *sseHub {
+	return &sseHub{clients: make(map[string]map[chan string]struct{})}
+}
+
+func (h *sseHub) Subscribe(title string) chan string {
+	ch := make(chan string, 4)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.clients[title] == nil {
+		h.clients[title] = make(map[chan string]struct{})
+	}
+	h.clients[title][ch] = struct{}{}
+
+	return ch
+}
+
+func (h *sseHub) Unsubscribe(title string, ch chan string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	delete(h.clients[title], ch)
+	close(ch)
+}
+
+func (h *sseHub) Publish(title, event string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for ch := range h.clients[title] {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
+
+// EventsHandler is an SSE endpoint that notifies any client viewing
+// title when it changes on disk, so an open /view/* tab can reload.
+func (s *Server) EventsHandler() httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		title := strings.TrimLeft(p.ByName("title"), "/")
+
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+
+		ch := s.sse.Subscribe(title)
+		defer s.sse.Unsubscribe(title, ch)
+
+		keepalive := time.NewTicker(15 * time.Second)
+		defer keepalive.Stop()
+
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case event := <-ch:
+				fmt.Fprintf(w, "event: %s\ndata: reload\n\n", event)
+				flusher.Flush()
+			case <-keepalive.C:
+				fmt.Fprint(w, ": keepalive\n\n")
+				flusher.Flush()
+			}
+		}
+	}
+}
+
+// PreviewHandler runs unsaved form content through the same
+// AutoCamelCase -> blackfriday -> bluemonday pipeline LoadPage uses
+// and returns the sanitized HTML, for the edit page's live preview.
+func (s *Server) PreviewHandler() httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		s.counters.Inc("n_preview")
+
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, "Internal Error", http.StatusInternalServerError)
+			return
+		}
+
+		u, err := url.Parse("/view/")
+		if err != nil {
+			http.Error(w, "Internal Error", http.StatusInternalServerError)
+			return
+		}
+		baseurl := r.URL.ResolveReference(u)
+
+		markdown := AutoCamelCase([]byte(r.Form.Get("body")), baseurl.String())
+		unsafe := blackfriday.Run(markdown, blackfriday.WithNoExtensions())
+		html := bluemonday.UGCPolicy().SanitizeBytes(unsafe)
+
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write(html)
+	}
+}
+
+// watchDev watches config.data, and every subdirectory under it, for
+// changes and publishes a reload event for any page whose file was
+// written, for use with --dev. Pages can live in nested
+// subdirectories (see walkTitles/mkSubDir), so the watch must be
+// recursive and follow newly created directories.
+func (s *Server) watchDev() error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+
+	err = filepath.Walk(s.config.data, func(fpath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return watcher.Add(fpath)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+
+				if event.Op&fsnotify.Create != 0 {
+					if info, err := os.Stat(event.Name); err == nil && info.IsDir() {
+						if err := watcher.Add(event.Name); err != nil {
+							s.logger.Printf("ERROR: fsnotify: %s\n", err.Error())
+						}
+						continue
+					}
+				}
+
+				if event.Op&(fsnotify.Write|fsnotify.Create) == 0 {
+					continue
+				}
+				if filepath.Ext(event.Name) != FileExtension {
+					continue
+				}
+
+				rel, err := filepath.Rel(s.config.data, event.Name)
+				if err != nil {
+					continue
+				}
+
+				title := strings.TrimSuffix(filepath.ToSlash(rel), FileExtension)
+				s.sse.Publish(title, "reload")
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				s.logger.Printf("ERROR: fsnotify: %s\n", err.Error())
+			}
+		}
+	}()
+
+	return nil
+}
@@ -0,0 +1,37 @@
+// Package atom provides minimal types for marshalling Atom 1.0 feeds.
+package atom
+
+import "encoding/xml"
+
+// Link is an Atom <link> element.
+type Link struct {
+	Rel  string `xml:"rel,attr"`
+	Type string `xml:"type,attr,omitempty"`
+	Href string `xml:"href,attr"`
+}
+
+// FeedContent is the <content> element of a feed entry.
+type FeedContent struct {
+	Type    string `xml:"type,attr"`
+	Content string `xml:",chardata"`
+}
+
+// FeedEntry is a single <entry> in a Feed.
+type FeedEntry struct {
+	Title   string      `xml:"title"`
+	Link    Link        `xml:"link"`
+	ID      string      `xml:"id"`
+	Updated string      `xml:"updated"`
+	Summary string      `xml:"summary,omitempty"`
+	Content FeedContent `xml:"content"`
+}
+
+// Feed is the Atom 1.0 feed root element.
+type Feed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	Title   string      `xml:"title"`
+	ID      string      `xml:"id"`
+	Updated string      `xml:"updated"`
+	Links   []Link      `xml:"link"`
+	Entries []FeedEntry `xml:"entry"`
+}
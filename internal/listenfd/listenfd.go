@@ -0,0 +1,56 @@
+// Package listenfd lets a process accept connections on a listener
+// inherited from systemd socket activation (or systemfd), falling
+// back to dialing an address when no descriptors were inherited.
+package listenfd
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+)
+
+// firstListenFD is the file descriptor systemd (and systemfd) place
+// the first passed socket on.
+const firstListenFD = 3
+
+// Listen returns a listener wrapping the file descriptor inherited
+// via LISTEN_FDS/LISTEN_PID, or dials fallback ("host:port") when no
+// descriptors were inherited.
+func Listen(fallback string) (net.Listener, error) {
+	l, ok, err := fromEnv()
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		return l, nil
+	}
+
+	return net.Listen("tcp", fallback)
+}
+
+// fromEnv wraps the inherited file descriptor with net.FileListener
+// when LISTEN_FDS/LISTEN_PID indicate one was passed to this process.
+func fromEnv() (net.Listener, bool, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, false, nil
+	}
+
+	nfds, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || nfds < 1 {
+		return nil, false, nil
+	}
+
+	file := os.NewFile(uintptr(firstListenFD), "LISTEN_FD_3")
+	if file == nil {
+		return nil, false, fmt.Errorf("listenfd: invalid inherited file descriptor %d", firstListenFD)
+	}
+
+	l, err := net.FileListener(file)
+	if err != nil {
+		return nil, false, err
+	}
+
+	return l, true, nil
+}
@@ -0,0 +1,18 @@
+// Package sitemap provides minimal types for marshalling a Sitemap
+// 0.9 urlset, as used by search engines for crawl discovery.
+package sitemap
+
+import "encoding/xml"
+
+// URL is a single <url> entry in a sitemap.
+type URL struct {
+	Loc        string `xml:"loc"`
+	LastMod    string `xml:"lastmod,omitempty"`
+	ChangeFreq string `xml:"changefreq,omitempty"`
+}
+
+// URLSet is the Sitemap 0.9 <urlset> root element.
+type URLSet struct {
+	XMLName xml.Name `xml:"http://www.sitemaps.org/schemas/sitemap/0.9 urlset"`
+	URLs    []URL    `xml:"url"`
+}
@@ -1,18 +1,22 @@
 package main
 
 import (
+	"compress/gzip"
+	"context"
 	"encoding/json"
-	"errors"
+	"encoding/xml"
 	"fmt"
 	"html/template"
-	"io/ioutil"
+	"io"
 	"log"
 	"net/http"
 	"net/url"
 	"os"
-	"path"
+	"os/signal"
 	"regexp"
+	"sort"
 	"strings"
+	"syscall"
 	"time"
 
 	// Logging
@@ -27,12 +31,29 @@ import (
 	"github.com/julienschmidt/httprouter"
 	"github.com/microcosm-cc/bluemonday"
 	"github.com/russross/blackfriday/v2"
+
+	"github.com/prologic/wiki/internal/atom"
+	"github.com/prologic/wiki/internal/listenfd"
+	"github.com/prologic/wiki/internal/sitemap"
 )
 
 var (
 	validPath = regexp.MustCompile("^/(edit|save|view)/([a-zA-Z0-9]+)$")
 )
 
+// atomFeedSize is the number of most recently modified pages included
+// in the Atom feed.
+const atomFeedSize = 20
+
+// MakeTagURI builds a stable tag: URI (RFC 4151) identifying a page,
+// so feed entry IDs remain the same across edits and re-renders.
+func MakeTagURI(config Config, title string) string {
+	return fmt.Sprintf(
+		"tag:%s,%s:%s",
+		config.host, config.domainStartDate.Format("2006-01-02"), title,
+	)
+}
+
 // Page ...
 type Page struct {
 	Title string
@@ -42,39 +63,13 @@ type Page struct {
 	Date  time.Time
 }
 
-// make sure user input path does not leave the directory
-func mkSubDir(dir string, file string) error {
-	d := path.Clean(dir)
-	sd := path.Dir(path.Clean(path.Join(d, file)))
-	if sd[ 0:len(d) ] != d {
-		return errors.New("File in wrong directory")
-	}
-	return os.MkdirAll(sd, 0755)
-}
-
-func (p *Page) Save(datadir string) error {
-	filename := p.Title + FileExtension
-	filepath := path.Join(datadir, filename)
-
-	if err := mkSubDir(datadir, filename); err != nil {
-		return err
-	}
-
-	return ioutil.WriteFile(filepath, p.Body, 0600)
-}
-
-// LoadPage ...
-func LoadPage(title string, config Config, baseurl *url.URL) (*Page, error) {
-	filename := path.Join(config.data, title + FileExtension)
-	body, err := ioutil.ReadFile(filename)
+// LoadPage reads title from the server's PageStore and runs it
+// through the AutoCamelCase -> blackfriday -> bluemonday pipeline.
+func (s *Server) LoadPage(title string, baseurl *url.URL) (*Page, error) {
+	body, mtime, err := s.store.Get(title)
 	if err != nil {
 		return nil, err
 	}
-	fi, err := os.Stat(filename)
-	if err != nil {
-		return nil, err
-	}
-	mtime := fi.ModTime()
 
 	// Process and Parse the Markdown content
 	// Also automatically replace CamelCase page identifiers as links
@@ -87,7 +82,7 @@ func LoadPage(title string, config Config, baseurl *url.URL) (*Page, error) {
 		Title: title,
 		Body:  body,
 		HTML:  template.HTML(html),
-		Brand: config.brand,
+		Brand: s.config.brand,
 		Date:  mtime,
 	}, nil
 }
@@ -126,6 +121,12 @@ type Server struct {
 	templates *Templates
 	router    *httprouter.Router
 
+	// store is where page content comes from; see PageStore.
+	store PageStore
+
+	// sse fans out live-reload notifications when running with --dev.
+	sse *sseHub
+
 	// Logger
 	logger *logger.Logger
 
@@ -173,7 +174,7 @@ func (s *Server) EditHandler() httprouter.Handle {
 		}
 		baseurl := r.URL.ResolveReference(u)
 
-		page, err := LoadPage(title, s.config, baseurl)
+		page, err := s.LoadPage(title, baseurl)
 		if err != nil {
 			page = &Page{Title: title, Brand: s.config.brand}
 		}
@@ -196,9 +197,14 @@ func (s *Server) SaveHandler() httprouter.Handle {
 		}
 
 		body := r.Form.Get("body")
+		author := r.Header.Get("X-Wiki-Author")
+		message := r.Form.Get("message")
 
-		page := &Page{Title: title, Body: []byte(body), Brand: s.config.brand}
-		err = page.Save(s.config.data)
+		if as, ok := s.store.(AuthorStore); ok {
+			err = as.PutWithAuthor(title, []byte(body), author, message)
+		} else {
+			err = s.store.Put(title, []byte(body))
+		}
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
@@ -226,7 +232,7 @@ func (s *Server) ViewHandler() httprouter.Handle {
 		}
 		baseurl := r.URL.ResolveReference(u)
 
-		page, err := LoadPage(title, s.config, baseurl)
+		page, err := s.LoadPage(title, baseurl)
 		if err != nil {
 			u, err := url.Parse(fmt.Sprintf("/edit/%s", title))
 			if err != nil {
@@ -272,16 +278,275 @@ func (s *Server) SearchHandler() httprouter.Handle {
 	}
 }
 
-// ListenAndServe ...
+// AtomHandler serves an Atom feed of the most recently modified pages.
+func (s *Server) AtomHandler() httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		type recentPage struct {
+			title string
+			mtime time.Time
+		}
+
+		var pages []recentPage
+
+		titles, err := s.store.List()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		for _, title := range titles {
+			_, mtime, err := s.store.Get(title)
+			if err != nil {
+				continue
+			}
+
+			pages = append(pages, recentPage{title: title, mtime: mtime})
+		}
+
+		sort.Slice(pages, func(i, j int) bool {
+			return pages[i].mtime.After(pages[j].mtime)
+		})
+
+		if len(pages) > atomFeedSize {
+			pages = pages[:atomFeedSize]
+		}
+
+		u, err := url.Parse("/view/")
+		if err != nil {
+			http.Error(w, "Internal Error", http.StatusInternalServerError)
+			return
+		}
+		baseurl := r.URL.ResolveReference(u)
+
+		selfURL := r.URL.ResolveReference(&url.URL{Path: "/feed.atom"})
+		alternateURL := r.URL.ResolveReference(&url.URL{Path: "/"})
+
+		feed := atom.Feed{
+			Title: s.config.brand,
+			ID:    MakeTagURI(s.config, ""),
+			Links: []atom.Link{
+				{Rel: "self", Type: "application/atom+xml", Href: selfURL.String()},
+				{Rel: "alternate", Type: "text/html", Href: alternateURL.String()},
+			},
+		}
+
+		if len(pages) > 0 {
+			feed.Updated = pages[0].mtime.UTC().Format(time.RFC3339)
+		} else {
+			feed.Updated = time.Now().UTC().Format(time.RFC3339)
+		}
+
+		for _, rp := range pages {
+			page, err := s.LoadPage(rp.title, baseurl)
+			if err != nil {
+				continue
+			}
+
+			entryURL := r.URL.ResolveReference(&url.URL{Path: "/view/" + rp.title})
+
+			feed.Entries = append(feed.Entries, atom.FeedEntry{
+				Title: rp.title,
+				Link: atom.Link{
+					Rel: "alternate", Type: "text/html", Href: entryURL.String(),
+				},
+				ID:      MakeTagURI(s.config, rp.title),
+				Updated: rp.mtime.UTC().Format(time.RFC3339),
+				Content: atom.FeedContent{Type: "html", Content: string(page.HTML)},
+			})
+		}
+
+		bs, err := xml.MarshalIndent(feed, "", "  ")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/atom+xml; charset=utf-8")
+		w.Write([]byte(xml.Header))
+		w.Write(bs)
+	}
+}
+
+// HistoryHandler lists a page's revisions, most recent first.
+func (s *Server) HistoryHandler() httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		s.counters.Inc("n_history")
+
+		title := strings.TrimLeft(p.ByName("title"), "/")
+
+		revisions, err := s.store.History(title)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		s.render("history", w, struct {
+			Title     string
+			Brand     string
+			Revisions []Revision
+		}{
+			Title:     title,
+			Brand:     s.config.brand,
+			Revisions: revisions,
+		})
+	}
+}
+
+// DiffHandler renders a unified diff between two revisions given as
+// ?from=<hash>&to=<hash> query parameters, under the page's title.
+// The diff covers every file changed between the two revisions, not
+// only the page's own file. It requires a git-backed PageStore.
+func (s *Server) DiffHandler() httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		s.counters.Inc("n_diff")
+
+		title := strings.TrimLeft(p.ByName("title"), "/")
+		from := r.URL.Query().Get("from")
+		to := r.URL.Query().Get("to")
+
+		gitStore, ok := s.store.(*GitStore)
+		if !ok {
+			http.Error(w, "diff view requires a git page store", http.StatusNotImplemented)
+			return
+		}
+
+		diff, err := gitStore.Diff(title, from, to)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		s.render("diff", w, struct {
+			Title string
+			Brand string
+			From  string
+			To    string
+			Diff  string
+		}{
+			Title: title,
+			Brand: s.config.brand,
+			From:  from,
+			To:    to,
+			Diff:  diff,
+		})
+	}
+}
+
+// SitemapHandler serves an XML sitemap of every page, gzipped when
+// the client advertises support for it.
+func (s *Server) SitemapHandler() httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		titles, err := s.store.List()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		baseURL, err := url.Parse(s.config.baseURL)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		urlset := sitemap.URLSet{}
+
+		for _, title := range titles {
+			_, mtime, err := s.store.Get(title)
+			if err != nil {
+				continue
+			}
+
+			loc := baseURL.ResolveReference(&url.URL{Path: "/view/" + title})
+
+			urlset.URLs = append(urlset.URLs, sitemap.URL{
+				Loc:        loc.String(),
+				LastMod:    mtime.UTC().Format(time.RFC3339),
+				ChangeFreq: "weekly",
+			})
+		}
+
+		bs, err := xml.MarshalIndent(urlset, "", "  ")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		body := append([]byte(xml.Header), bs...)
+
+		w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+
+		if strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+			w.Header().Set("Content-Encoding", "gzip")
+			gz := gzip.NewWriter(w)
+			defer gz.Close()
+			gz.Write(body)
+			return
+		}
+
+		w.Write(body)
+	}
+}
+
+// RobotsHandler serves a robots.txt that points crawlers at the
+// sitemap.
+func (s *Server) RobotsHandler() httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprintf(
+			w, "User-agent: *\nAllow: /\nSitemap: %s/sitemap.xml\n",
+			strings.TrimRight(s.config.baseURL, "/"),
+		)
+	}
+}
+
+// ListenAndServe listens on a systemd-activated socket when one was
+// inherited, or on config.bind otherwise, and shuts down gracefully
+// on SIGINT/SIGTERM: in-flight requests are drained before the page
+// store is closed and the process exits.
 func (s *Server) ListenAndServe() {
-	log.Fatal(
-		http.ListenAndServe(
-			s.config.bind,
-			s.logger.Handler(
-				s.stats.Handler(s.router),
+	listener, err := listenfd.Listen(s.config.bind)
+	if err != nil {
+		log.Fatalf("error listening on %s: %s", s.config.bind, err)
+	}
+
+	httpServer := &http.Server{
+		Handler: s.logger.Handler(
+			s.stats.Handler(
+				CSPMiddleware(s.config.csp, s.router),
 			),
 		),
-	)
+	}
+
+	shutdown := make(chan struct{})
+
+	go func() {
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+		<-sigs
+
+		s.logger.Printf("shutting down...\n")
+
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+
+		if err := httpServer.Shutdown(ctx); err != nil {
+			s.logger.Printf("ERROR: graceful shutdown: %s\n", err.Error())
+		}
+
+		if closer, ok := s.store.(io.Closer); ok {
+			if err := closer.Close(); err != nil {
+				s.logger.Printf("ERROR: closing page store: %s\n", err.Error())
+			}
+		}
+
+		close(shutdown)
+	}()
+
+	if err := httpServer.Serve(listener); err != nil && err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+
+	<-shutdown
 }
 
 func (s *Server) initRoutes() {
@@ -303,14 +568,28 @@ func (s *Server) initRoutes() {
 	s.router.GET("/edit/*title", s.EditHandler())
 	s.router.POST("/save/*title", s.SaveHandler())
 	s.router.POST("/search", s.SearchHandler())
+	s.router.GET("/feed.atom", s.AtomHandler())
+	s.router.GET("/history/*title", s.HistoryHandler())
+	s.router.GET("/diff/*title", s.DiffHandler())
+	s.router.GET("/sitemap.xml", s.SitemapHandler())
+	s.router.GET("/robots.txt", s.RobotsHandler())
+	s.router.GET("/events/*title", s.EventsHandler())
+	s.router.POST("/preview", s.PreviewHandler())
 }
 
 // NewServer ...
 func NewServer(config Config) *Server {
+	store, err := newPageStore(config)
+	if err != nil {
+		log.Fatalf("error opening page store: %s", err)
+	}
+
 	server := &Server{
 		config:    config,
 		router:    httprouter.New(),
 		templates: NewTemplates("base"),
+		store:     store,
+		sse:       newSSEHub(),
 
 		// Logger
 		logger: logger.New(logger.Options{
@@ -335,8 +614,18 @@ func NewServer(config Config) *Server {
 	template.Must(viewTemplate.Parse(box.MustString("view.html")))
 	template.Must(viewTemplate.Parse(box.MustString("base.html")))
 
+	historyTemplate := template.New("view")
+	template.Must(historyTemplate.Parse(box.MustString("history.html")))
+	template.Must(historyTemplate.Parse(box.MustString("base.html")))
+
+	diffTemplate := template.New("view")
+	template.Must(diffTemplate.Parse(box.MustString("diff.html")))
+	template.Must(diffTemplate.Parse(box.MustString("base.html")))
+
 	server.templates.Add("edit", editTemplate)
 	server.templates.Add("view", viewTemplate)
+	server.templates.Add("history", historyTemplate)
+	server.templates.Add("diff", diffTemplate)
 
 	/*
 		err := server.templates.Load()
@@ -347,5 +636,11 @@ func NewServer(config Config) *Server {
 
 	server.initRoutes()
 
+	if config.dev {
+		if err := server.watchDev(); err != nil {
+			log.Fatalf("error watching %s for live-reload: %s", config.data, err)
+		}
+	}
+
 	return server
 }
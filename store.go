@@ -0,0 +1,661 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	git "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+)
+
+// Revision describes a single historical revision of a page.
+type Revision struct {
+	Hash    string
+	Author  string
+	When    time.Time
+	Message string
+}
+
+// PageStore abstracts how page content is read from and written to,
+// so handlers don't need to know whether pages live in a plain
+// directory of Markdown files or a git repository.
+type PageStore interface {
+	// Get returns a page's body and last-modified time.
+	Get(title string) ([]byte, time.Time, error)
+	// Put writes a page's body, creating it if necessary.
+	Put(title string, body []byte) error
+	// List returns the titles of every page in the store.
+	List() ([]string, error)
+	// History returns a page's revisions, most recent first. Stores
+	// with no concept of history return an empty slice.
+	History(title string) ([]Revision, error)
+}
+
+// AuthorStore is implemented by stores that can attribute a Put to a
+// specific author and record a commit message for it.
+type AuthorStore interface {
+	PutWithAuthor(title string, body []byte, author, message string) error
+}
+
+// make sure user input path does not leave the directory
+func mkSubDir(dir string, file string) error {
+	d := path.Clean(dir)
+	sd := path.Dir(path.Clean(path.Join(d, file)))
+	if sd[0:len(d)] != d {
+		return errors.New("File in wrong directory")
+	}
+	return os.MkdirAll(sd, 0755)
+}
+
+func walkTitles(dir string) ([]string, error) {
+	var titles []string
+
+	err := filepath.Walk(dir, func(fpath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || filepath.Ext(fpath) != FileExtension {
+			return nil
+		}
+
+		rel, err := filepath.Rel(dir, fpath)
+		if err != nil {
+			return err
+		}
+
+		titles = append(titles, strings.TrimSuffix(filepath.ToSlash(rel), FileExtension))
+		return nil
+	})
+
+	return titles, err
+}
+
+// newPageStore builds the PageStore selected by config.store: "fs"
+// (the default), "git" (a checked-out working tree), or "gitremote"
+// (a bare repository with no working tree, for running a wiki
+// straight off a shared git remote).
+func newPageStore(config Config) (PageStore, error) {
+	switch config.store {
+	case "git":
+		return NewGitStore(config.data, config.git, false)
+	case "gitremote":
+		return NewGitStore(config.data, config.git, true)
+	default:
+		return NewFSStore(config.data), nil
+	}
+}
+
+// FSStore is a PageStore backed by a plain directory of Markdown
+// files on disk. It has no notion of history.
+type FSStore struct {
+	dir string
+}
+
+// NewFSStore ...
+func NewFSStore(dir string) *FSStore {
+	return &FSStore{dir: dir}
+}
+
+func (s *FSStore) filename(title string) string {
+	return path.Join(s.dir, title+FileExtension)
+}
+
+// Get ...
+func (s *FSStore) Get(title string) ([]byte, time.Time, error) {
+	filename := s.filename(title)
+
+	body, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	fi, err := os.Stat(filename)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	return body, fi.ModTime(), nil
+}
+
+// Put ...
+func (s *FSStore) Put(title string, body []byte) error {
+	filename := title + FileExtension
+
+	if err := mkSubDir(s.dir, filename); err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(path.Join(s.dir, filename), body, 0600)
+}
+
+// List ...
+func (s *FSStore) List() ([]string, error) {
+	return walkTitles(s.dir)
+}
+
+// History always returns no revisions: a plain filesystem directory
+// keeps no record of prior versions.
+func (s *FSStore) History(title string) ([]Revision, error) {
+	return nil, nil
+}
+
+// GitStore is a PageStore backed by a git repository, managed with
+// go-git. Every Put is committed, and if cfg.push is set it is pushed
+// to the configured remote as well.
+//
+// In worktree mode (bare == false) reads and writes go through a
+// checked-out working tree on disk, the same as FSStore. In bare mode
+// (bare == true, "gitremote" in config.store) there is no working
+// tree at all: reads and writes go straight through go-git's object
+// store, so a wiki can run off a shared git remote with nothing but
+// its bare clone on disk.
+type GitStore struct {
+	dir  string
+	cfg  Git
+	repo *git.Repository
+	bare bool
+}
+
+// NewGitStore opens the git repository at dir, pulling from cfg.url
+// first when one is configured. When bare is false, dir must be a
+// non-bare repository with a checked-out working tree; when bare is
+// true, dir must be a bare repository (or a mirror clone of one).
+func NewGitStore(dir string, cfg Git, bare bool) (*GitStore, error) {
+	repo, err := git.PlainOpen(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	if !bare {
+		if _, err := repo.Worktree(); err != nil {
+			return nil, fmt.Errorf("git store requires a working tree: %w", err)
+		}
+	}
+
+	store := &GitStore{dir: dir, cfg: cfg, repo: repo, bare: bare}
+
+	if cfg.url != "" {
+		if err := store.pull(); err != nil {
+			return nil, err
+		}
+	}
+
+	return store, nil
+}
+
+func (s *GitStore) pull() error {
+	if s.bare {
+		return s.pullBare()
+	}
+	return s.pullWorktree()
+}
+
+func (s *GitStore) pullWorktree() error {
+	wt, err := s.repo.Worktree()
+	if err != nil {
+		return err
+	}
+
+	err = wt.Pull(&git.PullOptions{RemoteName: "origin"})
+	if err != nil && err != git.NoErrAlreadyUpToDate {
+		return err
+	}
+
+	return nil
+}
+
+// pullBare fetches from origin and fast-forwards the current branch
+// to match its remote-tracking ref. There is no working tree to
+// merge into, so this simply mirrors the remote rather than
+// attempting a real merge.
+func (s *GitStore) pullBare() error {
+	err := s.repo.Fetch(&git.FetchOptions{RemoteName: "origin"})
+	if err != nil && err != git.NoErrAlreadyUpToDate {
+		return err
+	}
+
+	head, err := s.repo.Head()
+	if err != nil {
+		return err
+	}
+
+	remoteRef, err := s.repo.Reference(plumbing.NewRemoteReferenceName("origin", head.Name().Short()), true)
+	if err != nil {
+		return err
+	}
+
+	return s.repo.Storer.SetReference(plumbing.NewHashReference(head.Name(), remoteRef.Hash()))
+}
+
+func (s *GitStore) push() error {
+	if err := s.repo.Push(&git.PushOptions{RemoteName: "origin"}); err != nil && err != git.NoErrAlreadyUpToDate {
+		return err
+	}
+	return nil
+}
+
+func (s *GitStore) filename(title string) string {
+	return path.Join(s.dir, title+FileExtension)
+}
+
+// Get ...
+func (s *GitStore) Get(title string) ([]byte, time.Time, error) {
+	if s.bare {
+		return s.getBare(title)
+	}
+	return s.getWorktree(title)
+}
+
+func (s *GitStore) getWorktree(title string) ([]byte, time.Time, error) {
+	filename := s.filename(title)
+
+	body, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	fi, err := os.Stat(filename)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	return body, fi.ModTime(), nil
+}
+
+// getBare reads title straight out of HEAD's tree, with no working
+// tree involved. The returned time is the HEAD commit's author time,
+// since there is no file mtime to fall back on.
+func (s *GitStore) getBare(title string) ([]byte, time.Time, error) {
+	head, err := s.repo.Head()
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	commit, err := s.repo.CommitObject(head.Hash())
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	file, err := commit.File(title + FileExtension)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	content, err := file.Contents()
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	return []byte(content), commit.Author.When, nil
+}
+
+// Put writes title's body and commits it to the working repo under a
+// default author, pushing to origin afterwards if cfg.push is set.
+func (s *GitStore) Put(title string, body []byte) error {
+	return s.PutWithAuthor(title, body, "", "")
+}
+
+// PutWithAuthor is like Put but lets the caller (e.g. SaveHandler,
+// from the X-Wiki-Author header) attribute the commit to a specific
+// author and message.
+func (s *GitStore) PutWithAuthor(title string, body []byte, author, message string) error {
+	if author == "" {
+		author = "wiki <wiki@localhost>"
+	}
+	if message == "" {
+		message = "Update " + title
+	}
+
+	return s.commit(title, body, author, message)
+}
+
+// commit writes title's body, committing it under author, and pushes
+// to origin when s.cfg.push is set.
+func (s *GitStore) commit(title string, body []byte, author, message string) error {
+	if s.bare {
+		return s.commitBare(title, body, author, message)
+	}
+	return s.commitWorktree(title, body, author, message)
+}
+
+// commitWorktree stages title's body on disk and commits it through
+// the working tree.
+func (s *GitStore) commitWorktree(title string, body []byte, author, message string) error {
+	filename := title + FileExtension
+
+	if err := mkSubDir(s.dir, filename); err != nil {
+		return err
+	}
+
+	if err := ioutil.WriteFile(path.Join(s.dir, filename), body, 0600); err != nil {
+		return err
+	}
+
+	wt, err := s.repo.Worktree()
+	if err != nil {
+		return err
+	}
+
+	if _, err := wt.Add(filename); err != nil {
+		return err
+	}
+
+	name, email := splitAuthor(author)
+
+	_, err = wt.Commit(message, &git.CommitOptions{
+		Author: &object.Signature{
+			Name:  name,
+			Email: email,
+			When:  time.Now(),
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	if s.cfg.push {
+		if err := s.push(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// commitBare writes title's body as a new blob, splices it into
+// HEAD's tree, and commits the result directly against the object
+// store, without ever checking anything out to disk.
+func (s *GitStore) commitBare(title string, body []byte, author, message string) error {
+	head, err := s.repo.Head()
+	if err != nil {
+		return err
+	}
+
+	parentCommit, err := s.repo.CommitObject(head.Hash())
+	if err != nil {
+		return err
+	}
+
+	parentTree, err := parentCommit.Tree()
+	if err != nil {
+		return err
+	}
+
+	blobHash, err := s.writeBlob(body)
+	if err != nil {
+		return err
+	}
+
+	parts := strings.Split(title+FileExtension, "/")
+
+	treeHash, err := updateTreePath(s.repo.Storer, parentTree, parts, blobHash)
+	if err != nil {
+		return err
+	}
+
+	name, email := splitAuthor(author)
+	sig := object.Signature{Name: name, Email: email, When: time.Now()}
+
+	commit := &object.Commit{
+		Author:       sig,
+		Committer:    sig,
+		Message:      message,
+		TreeHash:     treeHash,
+		ParentHashes: []plumbing.Hash{head.Hash()},
+	}
+
+	obj := s.repo.Storer.NewEncodedObject()
+	if err := commit.Encode(obj); err != nil {
+		return err
+	}
+
+	commitHash, err := s.repo.Storer.SetEncodedObject(obj)
+	if err != nil {
+		return err
+	}
+
+	if err := s.repo.Storer.SetReference(plumbing.NewHashReference(head.Name(), commitHash)); err != nil {
+		return err
+	}
+
+	if s.cfg.push {
+		if err := s.push(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// writeBlob stores body as a new blob object and returns its hash.
+func (s *GitStore) writeBlob(body []byte) (plumbing.Hash, error) {
+	obj := s.repo.Storer.NewEncodedObject()
+	obj.SetType(plumbing.BlobObject)
+
+	w, err := obj.Writer()
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+
+	if _, err := w.Write(body); err != nil {
+		w.Close()
+		return plumbing.ZeroHash, err
+	}
+	if err := w.Close(); err != nil {
+		return plumbing.ZeroHash, err
+	}
+
+	return s.repo.Storer.SetEncodedObject(obj)
+}
+
+// updateTreePath returns the hash of a new tree object equal to tree
+// (which may be nil, for a subdirectory that does not exist yet) with the blob at
+// parts spliced in, creating any intermediate subtrees as needed.
+// Sibling entries are left untouched.
+func updateTreePath(s storer.EncodedObjectStorer, tree *object.Tree, parts []string, blobHash plumbing.Hash) (plumbing.Hash, error) {
+	var entries []object.TreeEntry
+	if tree != nil {
+		entries = append(entries, tree.Entries...)
+	}
+
+	name := parts[0]
+
+	if len(parts) == 1 {
+		entry := object.TreeEntry{Name: name, Mode: filemode.Regular, Hash: blobHash}
+
+		replaced := false
+		for i, e := range entries {
+			if e.Name == name {
+				entries[i] = entry
+				replaced = true
+				break
+			}
+		}
+		if !replaced {
+			entries = append(entries, entry)
+		}
+	} else {
+		var subtree *object.Tree
+		idx := -1
+
+		for i, e := range entries {
+			if e.Name == name && e.Mode == filemode.Dir {
+				idx = i
+
+				t, err := object.GetTree(s, e.Hash)
+				if err != nil {
+					return plumbing.ZeroHash, err
+				}
+				subtree = t
+
+				break
+			}
+		}
+
+		subtreeHash, err := updateTreePath(s, subtree, parts[1:], blobHash)
+		if err != nil {
+			return plumbing.ZeroHash, err
+		}
+
+		entry := object.TreeEntry{Name: name, Mode: filemode.Dir, Hash: subtreeHash}
+		if idx >= 0 {
+			entries[idx] = entry
+		} else {
+			entries = append(entries, entry)
+		}
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return treeEntryLess(entries[i], entries[j])
+	})
+
+	tree = &object.Tree{Entries: entries}
+
+	obj := s.NewEncodedObject()
+	if err := tree.Encode(obj); err != nil {
+		return plumbing.ZeroHash, err
+	}
+
+	return s.SetEncodedObject(obj)
+}
+
+// treeEntryLess orders tree entries the way git requires: by name,
+// as if directory names had a trailing slash.
+func treeEntryLess(a, b object.TreeEntry) bool {
+	an, bn := a.Name, b.Name
+	if a.Mode == filemode.Dir {
+		an += "/"
+	}
+	if b.Mode == filemode.Dir {
+		bn += "/"
+	}
+	return an < bn
+}
+
+// splitAuthor splits a "Name <email>" string, as accepted from the
+// X-Wiki-Author header, into its parts for use in a git signature.
+func splitAuthor(author string) (name, email string) {
+	start := strings.IndexByte(author, '<')
+	end := strings.IndexByte(author, '>')
+	if start == -1 || end == -1 || end < start {
+		return author, ""
+	}
+
+	return strings.TrimSpace(author[:start]), strings.TrimSpace(author[start+1 : end])
+}
+
+// List ...
+func (s *GitStore) List() ([]string, error) {
+	if s.bare {
+		return s.listBare()
+	}
+	return walkTitles(s.dir)
+}
+
+// listBare returns the titles of every page by walking HEAD's tree,
+// with no working tree involved.
+func (s *GitStore) listBare() ([]string, error) {
+	head, err := s.repo.Head()
+	if err != nil {
+		return nil, err
+	}
+
+	commit, err := s.repo.CommitObject(head.Hash())
+	if err != nil {
+		return nil, err
+	}
+
+	tree, err := commit.Tree()
+	if err != nil {
+		return nil, err
+	}
+
+	var titles []string
+
+	walker := object.NewTreeWalker(tree, true, nil)
+	defer walker.Close()
+
+	for {
+		name, entry, err := walker.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if !entry.Mode.IsFile() || filepath.Ext(name) != FileExtension {
+			continue
+		}
+
+		titles = append(titles, strings.TrimSuffix(name, FileExtension))
+	}
+
+	return titles, nil
+}
+
+// History returns title's commit history by walking the repository's
+// HEAD log, filtering to commits that touched the page's file.
+func (s *GitStore) History(title string) ([]Revision, error) {
+	filename := title + FileExtension
+
+	head, err := s.repo.Head()
+	if err != nil {
+		return nil, err
+	}
+
+	cIter, err := s.repo.Log(&git.LogOptions{From: head.Hash(), FileName: &filename})
+	if err != nil {
+		return nil, err
+	}
+
+	var revisions []Revision
+
+	err = cIter.ForEach(func(c *object.Commit) error {
+		revisions = append(revisions, Revision{
+			Hash:    c.Hash.String(),
+			Author:  c.Author.Name,
+			When:    c.Author.When,
+			Message: strings.TrimSpace(c.Message),
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return revisions, nil
+}
+
+// Diff returns a unified diff between the trees of the from and to
+// commit hashes. It is not narrowed to title: every file changed
+// between the two commits is included.
+func (s *GitStore) Diff(title, from, to string) (string, error) {
+	fromCommit, err := s.repo.CommitObject(plumbing.NewHash(from))
+	if err != nil {
+		return "", err
+	}
+
+	toCommit, err := s.repo.CommitObject(plumbing.NewHash(to))
+	if err != nil {
+		return "", err
+	}
+
+	patch, err := fromCommit.Patch(toCommit)
+	if err != nil {
+		return "", err
+	}
+
+	return patch.String(), nil
+}